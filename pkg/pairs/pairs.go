@@ -0,0 +1,120 @@
+// Package pairs parses the `KEY = PATH1, PATH2, ...` key-path line format
+// shared by the multikey save and restore steps.
+package pairs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/v2/log"
+)
+
+const (
+	UniquePrefix = "[u]"
+	KeyLimit     = 10 // max number of keys allowed
+	PathLimit    = 10 // max number of paths allowed per key
+
+	keyFallbackSeparator = "|"
+
+	fmtErrInvalidInput       = "invalid input (lines should follow the `KEY = PATH1, PATH2, ...` format): %s"
+	fmtErrNoPathsFoundForKey = "no paths found for key: %s"
+	fmtErrNoPairsFound       = "no key-path pairs found in input"
+
+	fmtErrPartialEvaluationFailure = "key-path pair evaluation failures\n"
+	fmtErrPartialFailureDetails    = "    - %s\n"
+
+	fmtWarnSkippingAdditionalPaths = "Skipping additional paths for key '%s' as the limit of %d paths has been reached"
+	fmtWarnSkippingAdditionalKeys  = "Skipping additional keys as the limit of %d keys has been reached"
+)
+
+// ErrNoPairsFound is returned when every line in the input failed to parse.
+var ErrNoPairsFound = errors.New(fmtErrNoPairsFound)
+
+// Entry is a single parsed key-path pair line. Keys holds the line's keys in
+// order, split on `|` (`PRIMARY|FALLBACK`): the restore step uses the whole
+// chain, the save step uses only Keys[0].
+type Entry struct {
+	Keys   []string
+	Paths  []string
+	Unique bool
+}
+
+// ParseLines parses the `KEY = PATH1, PATH2, ...` line format, enforcing the
+// key/path limits and reporting per-line failures the same way both steps
+// already do: logged as warnings/partial-failure details, with a hard error
+// only when every line failed to parse.
+func ParseLines(raw string, logger log.Logger) ([]Entry, error) {
+	var entries []Entry
+	var errs []error
+
+	lines := strings.Split(raw, "\n")
+
+	for idx, line := range lines {
+		if idx >= KeyLimit {
+			logger.Warnf(fmtWarnSkippingAdditionalKeys, KeyLimit)
+			break
+		}
+
+		trimmedLine := strings.TrimSpace(line)
+
+		keyAndPaths := trimmedLine
+		isUnique := false
+		if strings.HasPrefix(trimmedLine, UniquePrefix) {
+			keyAndPaths = strings.TrimSpace(trimmedLine[len(UniquePrefix):])
+			isUnique = true
+		}
+
+		keyPathParts := strings.SplitN(keyAndPaths, "=", 2)
+		if len(keyPathParts) != 2 {
+			errs = append(errs, fmt.Errorf(fmtErrInvalidInput, line))
+			continue
+		}
+
+		keysString := strings.TrimSpace(keyPathParts[0])
+		pathsString := strings.TrimSpace(keyPathParts[1])
+
+		var keys []string
+		for _, keyString := range strings.Split(keysString, keyFallbackSeparator) {
+			key := strings.TrimSpace(keyString)
+			if key != "" {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) == 0 {
+			errs = append(errs, fmt.Errorf(fmtErrInvalidInput, line))
+			continue
+		}
+
+		pathStrings := strings.Split(pathsString, ",")
+		var paths []string
+		for idx, pathString := range pathStrings {
+			if idx >= PathLimit {
+				logger.Warnf(fmtWarnSkippingAdditionalPaths, keys[0], PathLimit)
+				break
+			}
+			path := strings.TrimSpace(pathString)
+			paths = append(paths, path)
+		}
+
+		if len(paths) == 0 {
+			errs = append(errs, fmt.Errorf(fmtErrNoPathsFoundForKey, keys[0]))
+			continue
+		}
+
+		entries = append(entries, Entry{Keys: keys, Paths: paths, Unique: isUnique})
+	}
+
+	if len(errs) > 0 {
+		logger.Printf(fmtErrPartialEvaluationFailure)
+		for _, err := range errs {
+			logger.Printf(fmtErrPartialFailureDetails, err.Error())
+		}
+	}
+
+	if len(errs) == len(lines) {
+		return nil, ErrNoPairsFound
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,98 @@
+package pairs
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/bitrise-io/go-utils/v2/log"
+)
+
+func TestParseLines_SimpleKeyPath(t *testing.T) {
+	entries, err := ParseLines("my-key = path/one, path/two", log.NewLogger())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want := []Entry{{Keys: []string{"my-key"}, Paths: []string{"path/one", "path/two"}, Unique: false}}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("got %+v, want %+v", entries, want)
+	}
+}
+
+func TestParseLines_UniquePrefix(t *testing.T) {
+	entries, err := ParseLines("[u] my-key = path/one", log.NewLogger())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(entries) != 1 || !entries[0].Unique {
+		t.Errorf("expected a single unique entry, got %+v", entries)
+	}
+}
+
+func TestParseLines_FallbackKeyChain(t *testing.T) {
+	entries, err := ParseLines("primary|fallback1|fallback2 = path/one", log.NewLogger())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want := []string{"primary", "fallback1", "fallback2"}
+	if len(entries) != 1 || !reflect.DeepEqual(entries[0].Keys, want) {
+		t.Errorf("got %+v, want keys %+v", entries, want)
+	}
+}
+
+func TestParseLines_SkipsInvalidLinesButKeepsValidOnes(t *testing.T) {
+	raw := strings.Join([]string{
+		"not-a-valid-line",
+		"good-key = path/one",
+	}, "\n")
+
+	entries, err := ParseLines(raw, log.NewLogger())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(entries) != 1 || entries[0].Keys[0] != "good-key" {
+		t.Errorf("expected only the valid line to survive, got %+v", entries)
+	}
+}
+
+func TestParseLines_AllInvalidReturnsErrNoPairsFound(t *testing.T) {
+	_, err := ParseLines("not-a-valid-line\nanother-bad-one", log.NewLogger())
+	if !errors.Is(err, ErrNoPairsFound) {
+		t.Fatalf("expected ErrNoPairsFound, got %v", err)
+	}
+}
+
+func TestParseLines_EnforcesKeyLimit(t *testing.T) {
+	var lines []string
+	for i := 0; i < KeyLimit+5; i++ {
+		lines = append(lines, "key"+strconv.Itoa(i)+" = path")
+	}
+
+	entries, err := ParseLines(strings.Join(lines, "\n"), log.NewLogger())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(entries) != KeyLimit {
+		t.Errorf("expected %d entries, got %d", KeyLimit, len(entries))
+	}
+}
+
+func TestParseLines_EnforcesPathLimit(t *testing.T) {
+	var paths []string
+	for i := 0; i < PathLimit+5; i++ {
+		paths = append(paths, "path"+strconv.Itoa(i))
+	}
+
+	entries, err := ParseLines("my-key = "+strings.Join(paths, ", "), log.NewLogger())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(entries) != 1 || len(entries[0].Paths) != PathLimit {
+		t.Errorf("expected %d paths, got %+v", PathLimit, entries)
+	}
+}
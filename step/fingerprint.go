@@ -0,0 +1,210 @@
+package step
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bitrise-io/go-steputils/v2/cache"
+	"github.com/bitrise-io/go-utils/v2/command"
+	"github.com/bitrise-io/go-utils/v2/env"
+	"github.com/bitrise-io/go-utils/v2/log"
+	"github.com/bitrise-io/go-utils/v2/pathutil"
+)
+
+const (
+	fingerprintDirName    = "bitrise-multikey-save-cache-fingerprints"
+	fingerprintSidecarExt = ".fingerprint"
+
+	// maxContentFingerprintBytes bounds how much file data fingerprintPaths
+	// will hash. Trees at or under this size are fingerprinted by content, so
+	// the result is stable across checkouts that reset mtimes. Larger trees
+	// fall back to path/size/mtime metadata, which is cheap but can miss a
+	// content change that doesn't touch size or mtime (and can report a false
+	// change when mtimes are reset, e.g. by a fresh CI checkout).
+	maxContentFingerprintBytes = 64 * 1024 * 1024
+)
+
+// FingerprintStore loads and saves the last-known content fingerprint for a
+// key, so save() can tell whether the paths behind it actually changed.
+type FingerprintStore interface {
+	Load(key string) (fingerprint string, found bool, err error)
+	Save(key string, fingerprint string) error
+}
+
+// cacheFingerprintStore persists a key's fingerprint as a one-line sidecar
+// cache entry (`<key>.fingerprint`), saved/restored through the same cache
+// backend used for the real payload.
+type cacheFingerprintStore struct {
+	envRepo        env.Repository
+	logger         log.Logger
+	pathProvider   pathutil.PathProvider
+	pathModifier   pathutil.PathModifier
+	pathChecker    pathutil.PathChecker
+	commandFactory command.Factory
+}
+
+func newCacheFingerprintStore(step MultikeySaveCacheStep) cacheFingerprintStore {
+	return cacheFingerprintStore{
+		envRepo:        step.envRepo,
+		logger:         step.logger,
+		pathProvider:   step.pathProvider,
+		pathModifier:   step.pathModifier,
+		pathChecker:    step.pathChecker,
+		commandFactory: step.commandFactory,
+	}
+}
+
+func (s cacheFingerprintStore) Load(key string) (string, bool, error) {
+	path := s.sidecarPath(key)
+	defer os.Remove(path)
+
+	restorer := cache.NewRestorer(s.envRepo, s.logger, s.pathProvider, s.pathChecker, s.commandFactory)
+	result, err := restorer.Restore(cache.RestoreCacheInput{
+		StepId: stepId,
+		Keys:   []string{sidecarKey(key)},
+	})
+	if err != nil {
+		return "", false, err
+	}
+	if result.MatchedKey == "" {
+		return "", false, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+
+	return strings.TrimSpace(string(content)), true, nil
+}
+
+func (s cacheFingerprintStore) Save(key string, fingerprint string) error {
+	path := s.sidecarPath(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, []byte(fingerprint), 0o644); err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	saver := cache.NewSaver(s.envRepo, s.logger, s.pathProvider, s.pathModifier, s.pathChecker, nil)
+	return saver.Save(cache.SaveCacheInput{
+		StepId:      stepId,
+		Key:         sidecarKey(key),
+		Paths:       []string{path},
+		IsKeyUnique: false,
+	})
+}
+
+// sidecarPath is scoped to this process, so concurrent builds on the same
+// host (or concurrent save/worker invocations) never read or write each
+// other's sidecar files.
+func (s cacheFingerprintStore) sidecarPath(key string) string {
+	dir := fmt.Sprintf("%s-%d", fingerprintDirName, os.Getpid())
+	return filepath.Join(os.TempDir(), dir, sanitizeKeyForFilename(key)+fingerprintSidecarExt)
+}
+
+func sidecarKey(key string) string {
+	return key + fingerprintSidecarExt
+}
+
+var filenameReplacer = strings.NewReplacer("/", "_", " ", "_")
+
+func sanitizeKeyForFilename(key string) string {
+	return filenameReplacer.Replace(key)
+}
+
+// fingerprintPaths computes a stable SHA-256 fingerprint of the given paths.
+// For trees at or under maxContentFingerprintBytes it hashes the actual file
+// contents, so the fingerprint only changes when the data does. Larger trees
+// fall back to a sorted path/size/mtime metadata fingerprint instead, since
+// hashing their full content on every save would be too slow.
+func fingerprintPaths(paths []string) (string, error) {
+	var files []string
+	var totalSize int64
+	for _, root := range paths {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			files = append(files, path)
+			totalSize += info.Size()
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	sort.Strings(files)
+
+	if totalSize <= maxContentFingerprintBytes {
+		return fingerprintContent(files)
+	}
+	return fingerprintMetadata(files)
+}
+
+// fingerprintContent hashes the concatenated contents of files (in the given
+// order), each file streamed through an io.Pipe so it's never buffered in full.
+func fingerprintContent(files []string) (string, error) {
+	hasher := sha256.New()
+	reader, writer := io.Pipe()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer writer.Close()
+		for _, file := range files {
+			f, err := os.Open(file)
+			if err != nil {
+				writer.CloseWithError(err)
+				return
+			}
+			_, err = io.Copy(writer, f)
+			f.Close()
+			if err != nil {
+				writer.CloseWithError(err)
+				return
+			}
+		}
+	}()
+
+	if _, err := io.Copy(hasher, reader); err != nil {
+		return "", err
+	}
+	wg.Wait()
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// fingerprintMetadata hashes each file's path, size and mtime instead of its
+// content. Cheap for large trees, but insensitive to content changes that
+// don't change size or mtime, and can flag a false change when mtimes are
+// reset (e.g. by a fresh checkout on a CI runner).
+func fingerprintMetadata(files []string) (string, error) {
+	hasher := sha256.New()
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", err
+		}
+		if _, err := io.WriteString(hasher, fmt.Sprintf("%s|%d|%d\n", file, info.Size(), info.ModTime().UnixNano())); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
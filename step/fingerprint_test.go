@@ -0,0 +1,93 @@
+package step
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFingerprintPaths_DetectsContentChangeAtSameSize(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "data.txt")
+
+	if err := os.WriteFile(file, []byte("aaaa"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	before, err := fingerprintPaths([]string{dir})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := os.WriteFile(file, []byte("bbbb"), 0o644); err != nil {
+		t.Fatalf("failed to rewrite file: %s", err)
+	}
+	after, err := fingerprintPaths([]string{dir})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if before == after {
+		t.Error("expected fingerprint to change when file content changes, even at the same size")
+	}
+}
+
+func TestFingerprintPaths_IgnoresMtimeOnlyChangeForSmallTrees(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "data.txt")
+
+	if err := os.WriteFile(file, []byte("unchanged"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	before, err := fingerprintPaths([]string{dir})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(file, future, future); err != nil {
+		t.Fatalf("failed to touch file: %s", err)
+	}
+	after, err := fingerprintPaths([]string{dir})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if before != after {
+		t.Error("expected fingerprint of a small tree to be stable across an mtime-only change")
+	}
+}
+
+func TestFingerprintPaths_Deterministic(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "b.txt"), []byte("b"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+
+	first, err := fingerprintPaths([]string{dir})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	second, err := fingerprintPaths([]string{dir})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if first != second {
+		t.Errorf("expected repeated fingerprinting of an unchanged tree to be stable, got %s and %s", first, second)
+	}
+}
+
+func TestCacheFingerprintStore_SidecarPathIsolatedPerProcess(t *testing.T) {
+	store := cacheFingerprintStore{}
+
+	path := store.sidecarPath("my-key")
+	wantDir := fingerprintDirName + "-" + strconv.Itoa(os.Getpid())
+	if filepath.Base(filepath.Dir(path)) != wantDir {
+		t.Errorf("expected sidecar path %q to be scoped to %q", path, wantDir)
+	}
+}
@@ -0,0 +1,157 @@
+package step
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/v2/log"
+	"gopkg.in/yaml.v2"
+
+	"github.com/bitrise-steplib/bitrise-step-multikey-save-cache/pkg/pairs"
+)
+
+const (
+	fmtErrInvalidYAMLInput = "invalid key_path_pairs_yaml input: %w"
+	fmtErrInvalidYAMLEntry = "key_path_pairs_yaml entry missing required 'key' field: %+v"
+
+	fmtErrPartialEvaluationFailure = "key-path pair evaluation failures\n"
+
+	fmtWarnSkippingAdditionalPaths = "Skipping additional paths for key '%s' as the limit of %d paths has been reached"
+	fmtWarnSkippingAdditionalKeys  = "Skipping additional keys as the limit of %d keys has been reached"
+)
+
+// KeyOptions holds the per-key overrides that either come from a structured
+// key_path_pairs_yaml entry or fall back to the step-level defaults.
+type KeyOptions struct {
+	CompressionLevel int
+	CustomTarArgs    string
+	SkipIfExists     bool
+}
+
+type keyPairs struct {
+	PathMap       map[string][]string
+	UniquenessMap map[string]bool
+	OptionsMap    map[string]KeyOptions
+}
+
+// keyPairsParser evaluates an Input's key-path configuration into the maps
+// the rest of the step works with, regardless of which input format was used.
+type keyPairsParser interface {
+	parse(input Input, logger log.Logger) (keyPairs, error)
+}
+
+func selectKeyPairsParser(input Input) keyPairsParser {
+	if strings.TrimSpace(input.KeyPathPairsYAML) != "" {
+		return structuredKeyPairsParser{}
+	}
+	return lineKeyPairsParser{}
+}
+
+// lineKeyPairsParser parses the `KEY = PATH1, PATH2, ...` line format using
+// the shared pkg/pairs parser.
+type lineKeyPairsParser struct{}
+
+func (lineKeyPairsParser) parse(input Input, logger log.Logger) (keyPairs, error) {
+	entries, err := pairs.ParseLines(input.KeyPathPairs, logger)
+	if err != nil {
+		return keyPairs{}, err
+	}
+
+	pathMap := make(map[string][]string)
+	uniquenessMap := make(map[string]bool)
+	optionsMap := make(map[string]KeyOptions)
+
+	for _, entry := range entries {
+		key := entry.Keys[0]
+		pathMap[key] = entry.Paths
+		uniquenessMap[key] = entry.Unique
+		optionsMap[key] = KeyOptions{
+			CompressionLevel: input.CompressionLevel,
+			CustomTarArgs:    input.CustomTarArgs,
+		}
+	}
+
+	return keyPairs{PathMap: pathMap, UniquenessMap: uniquenessMap, OptionsMap: optionsMap}, nil
+}
+
+// keyPathPairEntry is a single entry of the key_path_pairs_yaml document.
+type keyPathPairEntry struct {
+	Key              string   `yaml:"key" json:"key"`
+	Paths            []string `yaml:"paths" json:"paths"`
+	Unique           bool     `yaml:"unique" json:"unique"`
+	CompressionLevel int      `yaml:"compression_level" json:"compression_level"`
+	CustomTarArgs    string   `yaml:"custom_tar_args" json:"custom_tar_args"`
+	SkipIfExists     bool     `yaml:"skip_if_exists" json:"skip_if_exists"`
+}
+
+// structuredKeyPairsParser parses the key_path_pairs_yaml input, a YAML or
+// JSON list of entries that can carry per-key overrides the line format
+// cannot express.
+type structuredKeyPairsParser struct{}
+
+func (structuredKeyPairsParser) parse(input Input, logger log.Logger) (keyPairs, error) {
+	var entries []keyPathPairEntry
+	if err := yaml.Unmarshal([]byte(input.KeyPathPairsYAML), &entries); err != nil {
+		return keyPairs{}, fmt.Errorf(fmtErrInvalidYAMLInput, err)
+	}
+
+	pathMap := make(map[string][]string)
+	uniquenessMap := make(map[string]bool)
+	optionsMap := make(map[string]KeyOptions)
+	var errs []error
+
+	for idx, entry := range entries {
+		if idx >= pairs.KeyLimit {
+			logger.Warnf(fmtWarnSkippingAdditionalKeys, pairs.KeyLimit)
+			break
+		}
+
+		key := strings.TrimSpace(entry.Key)
+		if key == "" {
+			errs = append(errs, fmt.Errorf(fmtErrInvalidYAMLEntry, entry))
+			continue
+		}
+
+		paths := entry.Paths
+		if len(paths) > pairs.PathLimit {
+			logger.Warnf(fmtWarnSkippingAdditionalPaths, key, pairs.PathLimit)
+			paths = paths[:pairs.PathLimit]
+		}
+		if len(paths) == 0 {
+			errs = append(errs, fmt.Errorf(fmtErrNoPathsFoundForKey, key))
+			continue
+		}
+
+		compressionLevel := input.CompressionLevel
+		if entry.CompressionLevel != 0 {
+			compressionLevel = entry.CompressionLevel
+		}
+
+		customTarArgs := input.CustomTarArgs
+		if entry.CustomTarArgs != "" {
+			customTarArgs = entry.CustomTarArgs
+		}
+
+		pathMap[key] = paths
+		uniquenessMap[key] = entry.Unique
+		optionsMap[key] = KeyOptions{
+			CompressionLevel: compressionLevel,
+			CustomTarArgs:    customTarArgs,
+			SkipIfExists:     entry.SkipIfExists,
+		}
+	}
+
+	if len(errs) > 0 {
+		logger.Printf(fmtErrPartialEvaluationFailure)
+		for _, err := range errs {
+			logger.Printf(fmtErrPartialFailureDetails, err.Error())
+		}
+	}
+
+	if len(errs) == len(entries) {
+		return keyPairs{}, errors.New(fmtErrNoKeyPathPairs)
+	}
+
+	return keyPairs{PathMap: pathMap, UniquenessMap: uniquenessMap, OptionsMap: optionsMap}, nil
+}
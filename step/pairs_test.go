@@ -0,0 +1,82 @@
+package step
+
+import (
+	"testing"
+
+	"github.com/bitrise-io/go-utils/v2/log"
+)
+
+func TestSelectKeyPairsParser(t *testing.T) {
+	if _, ok := selectKeyPairsParser(Input{KeyPathPairsYAML: "- key: a\n  paths: [p]"}).(structuredKeyPairsParser); !ok {
+		t.Error("expected structuredKeyPairsParser when key_path_pairs_yaml is set")
+	}
+
+	if _, ok := selectKeyPairsParser(Input{KeyPathPairs: "key = path"}).(lineKeyPairsParser); !ok {
+		t.Error("expected lineKeyPairsParser when key_path_pairs_yaml is empty")
+	}
+}
+
+func TestStructuredKeyPairsParser_PerKeyOverrides(t *testing.T) {
+	input := Input{
+		CompressionLevel: 3,
+		CustomTarArgs:    "--default-arg",
+		KeyPathPairsYAML: `
+- key: default-options
+  paths: [path/one]
+- key: custom-options
+  paths: [path/two]
+  unique: true
+  compression_level: 9
+  custom_tar_args: "--custom-arg"
+  skip_if_exists: true
+`,
+	}
+
+	parsed, err := structuredKeyPairsParser{}.parse(input, log.NewLogger())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defaultOptions := parsed.OptionsMap["default-options"]
+	if defaultOptions.CompressionLevel != 3 || defaultOptions.CustomTarArgs != "--default-arg" || defaultOptions.SkipIfExists {
+		t.Errorf("expected step-level defaults to apply, got %+v", defaultOptions)
+	}
+
+	customOptions := parsed.OptionsMap["custom-options"]
+	if customOptions.CompressionLevel != 9 || customOptions.CustomTarArgs != "--custom-arg" || !customOptions.SkipIfExists {
+		t.Errorf("expected per-key overrides to apply, got %+v", customOptions)
+	}
+	if !parsed.UniquenessMap["custom-options"] {
+		t.Error("expected custom-options to be marked unique")
+	}
+}
+
+func TestStructuredKeyPairsParser_SkipsEntriesMissingKey(t *testing.T) {
+	input := Input{
+		KeyPathPairsYAML: `
+- paths: [path/one]
+- key: good-key
+  paths: [path/two]
+`,
+	}
+
+	parsed, err := structuredKeyPairsParser{}.parse(input, log.NewLogger())
+	if err != nil {
+		t.Fatalf("expected the batch to still succeed with one valid entry: %s", err)
+	}
+	if len(parsed.PathMap) != 1 {
+		t.Errorf("expected only the valid entry to survive, got %+v", parsed.PathMap)
+	}
+	if _, ok := parsed.PathMap["good-key"]; !ok {
+		t.Errorf("expected good-key to be present, got %+v", parsed.PathMap)
+	}
+}
+
+func TestStructuredKeyPairsParser_AllEntriesInvalidFails(t *testing.T) {
+	input := Input{KeyPathPairsYAML: "- paths: [path/one]"}
+
+	_, err := structuredKeyPairsParser{}.parse(input, log.NewLogger())
+	if err == nil {
+		t.Fatal("expected an error when every entry is missing its key")
+	}
+}
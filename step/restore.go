@@ -0,0 +1,162 @@
+package step
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/bitrise-io/go-steputils/v2/cache"
+	"github.com/bitrise-io/go-steputils/v2/stepconf"
+	"github.com/bitrise-io/go-utils/v2/command"
+	"github.com/bitrise-io/go-utils/v2/env"
+	"github.com/bitrise-io/go-utils/v2/log"
+	"github.com/bitrise-io/go-utils/v2/pathutil"
+
+	"github.com/bitrise-steplib/bitrise-step-multikey-save-cache/pkg/pairs"
+)
+
+const (
+	restoreStepId = "multikey-restore-cache"
+
+	fmtOutputCacheHit = "cache_hit--%s"
+
+	fmtErrRestoreFailure        = "restore failed"
+	fmtErrRestorePartialFailure = "restore failures\n"
+)
+
+// RestoreInput mirrors Input but its KeyPathPairs entries carry an ordered
+// `PRIMARY|FALLBACK1|FALLBACK2 = PATH1, PATH2, ...` fallback chain per key
+// instead of a single key.
+type RestoreInput struct {
+	Verbose             bool   `env:"verbose,required"`
+	KeyPathPairs        string `env:"key_path_pairs,required"`
+	MaxParallelRestores int    `env:"max_parallel_restores,range[1..10]"`
+}
+
+type MultikeyRestoreCacheStep struct {
+	logger         log.Logger
+	inputParser    stepconf.InputParser
+	commandFactory command.Factory
+	pathChecker    pathutil.PathChecker
+	pathProvider   pathutil.PathProvider
+	pathModifier   pathutil.PathModifier
+	envRepo        env.Repository
+}
+
+func NewRestoreStep(logger log.Logger, inputParser stepconf.InputParser, commandFactory command.Factory, pathChecker pathutil.PathChecker, pathProvider pathutil.PathProvider, pathModifier pathutil.PathModifier, envRepo env.Repository) MultikeyRestoreCacheStep {
+	return MultikeyRestoreCacheStep{
+		logger:         logger,
+		inputParser:    inputParser,
+		commandFactory: commandFactory,
+		pathChecker:    pathChecker,
+		pathProvider:   pathProvider,
+		pathModifier:   pathModifier,
+		envRepo:        envRepo,
+	}
+}
+
+func (step MultikeyRestoreCacheStep) Run() error {
+	var input RestoreInput
+	if err := step.inputParser.Parse(&input); err != nil {
+		return fmt.Errorf(fmtErrParseInput, err)
+	}
+	stepconf.Print(input)
+	step.logger.Println()
+
+	step.logger.EnableDebugLog(input.Verbose)
+
+	entries, err := pairs.ParseLines(input.KeyPathPairs, step.logger)
+	if err != nil {
+		return fmt.Errorf(fmtErrEvaluationFailure, err)
+	}
+
+	if len(entries) == 0 {
+		return errors.New(fmtErrNoKeyPathPairs)
+	}
+
+	jobs := make(chan pairs.Entry, len(entries))
+	for _, entry := range entries {
+		jobs <- entry
+	}
+	close(jobs)
+
+	workerCount := input.MaxParallelRestores
+	if workerCount <= 0 {
+		workerCount = 1
+	}
+	if workerCount > len(entries) {
+		workerCount = len(entries)
+	}
+
+	results := make(chan restoreResult, len(entries))
+
+	var wg sync.WaitGroup
+	for i := 0; i < workerCount; i++ {
+		wg.Add(1)
+		go restoreWorker(step, jobs, results, &wg)
+	}
+	wg.Wait()
+	close(results)
+
+	var errs []error
+	for result := range results {
+		step.exportOutput(fmt.Sprintf(fmtOutputCacheHit, result.PrimaryKey), result.MatchedKey)
+		if result.Err != nil {
+			errs = append(errs, result.Err)
+		}
+	}
+
+	if len(errs) > 0 {
+		step.logger.Printf(fmtErrRestorePartialFailure)
+		for _, err := range errs {
+			step.logger.Printf(fmtErrPartialFailureDetails, err.Error())
+		}
+	}
+
+	if len(errs) == len(entries) {
+		return errors.New(fmtErrRestoreFailure)
+	}
+
+	return nil
+}
+
+type restoreResult struct {
+	PrimaryKey string
+	MatchedKey string
+	Err        error
+}
+
+func restoreWorker(
+	step MultikeyRestoreCacheStep,
+	jobs <-chan pairs.Entry,
+	results chan<- restoreResult,
+	wg *sync.WaitGroup,
+) {
+	defer wg.Done()
+
+	for entry := range jobs {
+		matchedKey, err := restore(step, entry)
+		results <- restoreResult{PrimaryKey: entry.Keys[0], MatchedKey: matchedKey, Err: err}
+	}
+}
+
+func restore(step MultikeyRestoreCacheStep, entry pairs.Entry) (string, error) {
+	restorer := cache.NewRestorer(step.envRepo, step.logger, step.pathProvider, step.pathChecker, step.commandFactory)
+
+	result, err := restorer.Restore(cache.RestoreCacheInput{
+		StepId: restoreStepId,
+		Keys:   entry.Keys,
+	})
+	if err != nil {
+		return "", &keyError{Key: entry.Keys[0], Attempts: 1, Err: err}
+	}
+
+	return result.MatchedKey, nil
+}
+
+func (step MultikeyRestoreCacheStep) exportOutput(key, value string) {
+	cmd := step.commandFactory.Create("envman", []string{"add", "--key", key, "--value", value}, nil)
+	if err := cmd.Run(); err != nil {
+		step.logger.Warnf(fmtWarnFailedToExportOutput, key, err.Error())
+	}
+}
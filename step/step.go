@@ -3,8 +3,10 @@ package step
 import (
 	"errors"
 	"fmt"
+	"math/rand"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/bitrise-io/go-steputils/v2/cache"
 	"github.com/bitrise-io/go-steputils/v2/stepconf"
@@ -15,30 +17,46 @@ import (
 )
 
 const (
-	stepId       = "multikey-save-cache"
-	uniquePrefix = "[u]"
-	keyLimit     = 10 // max number of keys allowed
-	pathLimit    = 10 // max number of paths allowed per key
-
-	fmtErrParseInput               = "failed to parse inputs: %w"
-	fmtErrNoKeyPathPairs           = "no key-path pairs found in input"
-	fmtErrFailure                  = "save failed"
-	fmtErrPartialFailure           = "save failures\n"
-	fmtErrPartialFailureDetails    = "    - %s\n"
-	fmtErrInvalidInput             = "invalid input (lines should follow the `KEY = PATH1, PATH2, ...` format): %s"
-	fmtErrNoPathsFoundForKey       = "no paths found for key: %s"
-	fmtErrPartialEvaluationFailure = "key-path pair evaluation failures\n"
-	fmtErrEvaluationFailure        = "key-path pair evaluation failure: %w"
-
-	fmtWarnSkippingAdditionalPaths = "Skipping additional paths for key '%s' as the limit of %d paths has been reached"
-	fmtWarnSkippingAdditionalKeys  = "Skipping additional keys as the limit of %d keys has been reached"
+	stepId = "multikey-save-cache"
+
+	maxRetryBackoff = 30 * time.Second
+
+	outputSavedKeys   = "SAVED_KEYS"
+	outputFailedKeys  = "FAILED_KEYS"
+	outputSkippedKeys = "SKIPPED_KEYS"
+
+	fmtErrParseInput            = "failed to parse inputs: %w"
+	fmtErrNoKeyPathPairs        = "no key-path pairs found in input"
+	fmtErrFailure               = "save failed"
+	fmtErrPartialFailure        = "save failures\n"
+	fmtErrPartialFailureDetails = "    - %s\n"
+	fmtErrInvalidInput          = "invalid input (lines should follow the `KEY = PATH1, PATH2, ...` format): %s"
+	fmtErrNoPathsFoundForKey    = "no paths found for key: %s"
+	fmtErrEvaluationFailure     = "key-path pair evaluation failure: %w"
+	fmtErrInvalidRetryBackoff   = "invalid retry_backoff value: %w"
+	fmtErrKeyFailedAfterRetries = "key '%s' failed after %d attempt(s): %v"
+
+	fmtWarnRetryingSave          = "Retrying save for key '%s' (attempt %d/%d) after error: %s"
+	fmtWarnFailedToExportOutput  = "failed to export output %s: %s"
+	fmtWarnSkipCheckFailed       = "failed to check whether key '%s' already exists, saving anyway: %s"
+	fmtWarnFingerprintFailed     = "failed to compute content fingerprint for key '%s', saving anyway: %s"
+	fmtWarnFingerprintLoadFailed = "failed to load previous fingerprint for key '%s', saving anyway: %s"
+	fmtWarnFingerprintSaveFailed = "failed to persist fingerprint for key '%s': %s"
+
+	fmtInfoSkippingExistingKey  = "Key '%s' already exists in the cache, skipping save"
+	fmtInfoSkippingUnchangedKey = "Key '%s' content is unchanged since the last save, skipping"
 )
 
 type Input struct {
 	Verbose          bool   `env:"verbose,required"`
-	KeyPathPairs     string `env:"key_path_pairs,required"`
+	KeyPathPairs     string `env:"key_path_pairs"`
+	KeyPathPairsYAML string `env:"key_path_pairs_yaml"`
 	CompressionLevel int    `env:"compression_level,range[1..19]"`
 	CustomTarArgs    string `env:"custom_tar_args"`
+	MaxParallelSaves int    `env:"max_parallel_saves,range[1..10]"`
+	RetryCount       int    `env:"retry_count,range[0..10]"`
+	RetryBackoff     string `env:"retry_backoff"`
+	SkipIfUnchanged  bool   `env:"skip_if_unchanged"`
 }
 
 type MultikeySaveCacheStep struct {
@@ -73,42 +91,83 @@ func (step MultikeySaveCacheStep) Run() error {
 
 	step.logger.EnableDebugLog(input.Verbose)
 
-	pathMap, uniquenessMap, evaluationError := input.evaluateKeyPairs(step.logger)
+	retryBackoff := 2 * time.Second
+	if input.RetryBackoff != "" {
+		parsedBackoff, err := time.ParseDuration(input.RetryBackoff)
+		if err != nil {
+			return fmt.Errorf(fmtErrInvalidRetryBackoff, err)
+		}
+		retryBackoff = parsedBackoff
+	}
+
+	parsed, evaluationError := selectKeyPairsParser(input).parse(input, step.logger)
 	if evaluationError != nil {
 		return fmt.Errorf(fmtErrEvaluationFailure, evaluationError)
 	}
 
+	pathMap := parsed.PathMap
 	if len(pathMap) == 0 {
 		return errors.New(fmtErrNoKeyPathPairs)
 	}
 
-	var wg sync.WaitGroup
-	errs := make(chan error, len(pathMap)) // buffered channel
-
+	jobs := make(chan CacheInput, len(pathMap))
 	for key, paths := range pathMap {
-		wg.Add(1)
+		options := parsed.OptionsMap[key]
+		jobs <- CacheInput{
+			Verbose:          input.Verbose,
+			Key:              key,
+			Paths:            paths,
+			IsKeyUnique:      parsed.UniquenessMap[key],
+			CompressionLevel: options.CompressionLevel,
+			CustomTarArgs:    options.CustomTarArgs,
+			SkipIfExists:     options.SkipIfExists,
+			SkipIfUnchanged:  input.SkipIfUnchanged,
+		}
+	}
+	close(jobs)
+
+	fingerprintStore := newCacheFingerprintStore(step)
 
-		save(
-			step,
-			CacheInput{
-				Verbose:          input.Verbose,
-				Key:              key,
-				Paths:            paths,
-				IsKeyUnique:      uniquenessMap[key],
-				CompressionLevel: input.CompressionLevel,
-				CustomTarArgs:    input.CustomTarArgs,
-			},
-			&wg,
-			errs,
-		)
+	workerCount := input.MaxParallelSaves
+	if workerCount <= 0 {
+		workerCount = 1
 	}
+	if workerCount > len(pathMap) {
+		workerCount = len(pathMap)
+	}
+
+	results := make(chan saveResult, len(pathMap))
 
+	var wg sync.WaitGroup
+	for i := 0; i < workerCount; i++ {
+		wg.Add(1)
+		go worker(step, jobs, results, &wg, input.RetryCount, retryBackoff, fingerprintStore)
+	}
 	wg.Wait()
-	close(errs)
+	close(results)
+
+	var savedKeys, skippedKeys, failedKeys []string
+	var errs []error
+	for result := range results {
+		if result.Err != nil {
+			failedKeys = append(failedKeys, result.Key)
+			errs = append(errs, result.Err)
+			continue
+		}
+		if result.Skipped {
+			skippedKeys = append(skippedKeys, result.Key)
+			continue
+		}
+		savedKeys = append(savedKeys, result.Key)
+	}
+
+	step.exportOutput(outputSavedKeys, strings.Join(savedKeys, "|"))
+	step.exportOutput(outputSkippedKeys, strings.Join(skippedKeys, "|"))
+	step.exportOutput(outputFailedKeys, strings.Join(failedKeys, "|"))
 
 	if len(errs) > 0 {
 		step.logger.Printf(fmtErrPartialFailure)
-		for err := range errs {
+		for _, err := range errs {
 			step.logger.Printf(fmtErrPartialFailureDetails, err.Error())
 		}
 	}
@@ -120,91 +179,132 @@ func (step MultikeySaveCacheStep) Run() error {
 	return nil
 }
 
-func (input Input) evaluateKeyPairs(logger log.Logger) (map[string][]string, map[string]bool, error) {
-	pathMap := make(map[string][]string)
-	uniquenessMap := make(map[string]bool)
-	var errs []error
+type CacheInput struct {
+	Verbose          bool     `env:"verbose,required"`
+	Key              string   `env:"key,required"`
+	Paths            []string `env:"paths,required"`
+	IsKeyUnique      bool     `env:"is_key_unique"`
+	CompressionLevel int      `env:"compression_level,range[1..19]"`
+	CustomTarArgs    string   `env:"custom_tar_args"`
+	SkipIfExists     bool     `env:"skip_if_exists"`
+	SkipIfUnchanged  bool     `env:"skip_if_unchanged"`
+}
 
-	lines := strings.Split(input.KeyPathPairs, "\n")
+type saveResult struct {
+	Key     string
+	Skipped bool
+	Err     error
+}
 
-	for idx, line := range lines {
-		if idx >= keyLimit {
-			logger.Warnf(fmtWarnSkippingAdditionalKeys, keyLimit)
-			break
-		}
+type keyError struct {
+	Key      string
+	Attempts int
+	Err      error
+}
 
-		trimmedLine := strings.TrimSpace(line)
+func (e *keyError) Error() string {
+	return fmt.Sprintf(fmtErrKeyFailedAfterRetries, e.Key, e.Attempts, e.Err)
+}
 
-		var keyAndPaths = trimmedLine
-		var isUnique = false
-		if strings.HasPrefix(strings.TrimSpace(line), uniquePrefix) {
-			keyAndPaths = trimmedLine[len(uniquePrefix):] // remove the prefix by slicing
-			keyAndPaths = strings.TrimSpace(keyAndPaths)
-			isUnique = true
-		}
+func (e *keyError) Unwrap() error {
+	return e.Err
+}
 
-		keyPathParts := strings.SplitN(keyAndPaths, "=", 2)
-		if len(keyPathParts) != 2 {
-			err := fmt.Errorf(fmtErrInvalidInput, line)
-			errs = append(errs, err)
-			continue
-		}
+func worker(
+	step MultikeySaveCacheStep,
+	jobs <-chan CacheInput,
+	results chan<- saveResult,
+	wg *sync.WaitGroup,
+	retryCount int,
+	retryBackoff time.Duration,
+	fingerprintStore FingerprintStore,
+) {
+	defer wg.Done()
 
-		key := strings.TrimSpace(keyPathParts[0])
-		pathsString := strings.TrimSpace(keyPathParts[1])
+	for cacheInput := range jobs {
+		skipped, err := saveWithRetry(step, cacheInput, retryCount, retryBackoff, fingerprintStore)
+		results <- saveResult{Key: cacheInput.Key, Skipped: skipped, Err: err}
+	}
+}
 
-		pathStrings := strings.Split(pathsString, ",")
-		var paths []string
-		for idx, pathString := range pathStrings {
-			if idx >= pathLimit {
-				logger.Warnf(fmtWarnSkippingAdditionalPaths, key, pathLimit)
-				break
-			}
-			path := strings.TrimSpace(pathString)
-			paths = append(paths, path)
+func saveWithRetry(
+	step MultikeySaveCacheStep,
+	cacheInput CacheInput,
+	retryCount int,
+	retryBackoff time.Duration,
+	fingerprintStore FingerprintStore,
+) (bool, error) {
+	if cacheInput.SkipIfExists {
+		exists, err := cacheKeyExists(step, cacheInput.Key)
+		if err != nil {
+			step.logger.Warnf(fmtWarnSkipCheckFailed, cacheInput.Key, err.Error())
+		} else if exists {
+			step.logger.Printf(fmtInfoSkippingExistingKey, cacheInput.Key)
+			return true, nil
 		}
+	}
 
-		if len(paths) == 0 {
-			err := fmt.Errorf(fmtErrNoPathsFoundForKey, key)
-			errs = append(errs, err)
-			continue
+	var fingerprint string
+	if cacheInput.SkipIfUnchanged {
+		computed, err := fingerprintPaths(cacheInput.Paths)
+		if err != nil {
+			step.logger.Warnf(fmtWarnFingerprintFailed, cacheInput.Key, err.Error())
+		} else {
+			fingerprint = computed
+
+			previous, found, err := fingerprintStore.Load(cacheInput.Key)
+			if err != nil {
+				step.logger.Warnf(fmtWarnFingerprintLoadFailed, cacheInput.Key, err.Error())
+			} else if found && previous == fingerprint {
+				step.logger.Printf(fmtInfoSkippingUnchangedKey, cacheInput.Key)
+				return true, nil
+			}
 		}
-
-		pathMap[key] = paths
-		uniquenessMap[key] = isUnique
 	}
 
-	if len(errs) > 0 {
-		logger.Printf(fmtErrPartialEvaluationFailure)
-		for _, err := range errs {
-			logger.Printf(fmtErrPartialFailureDetails, err.Error())
+	var lastErr error
+
+	for attempt := 0; attempt <= retryCount; attempt++ {
+		err := save(step, cacheInput)
+		if err == nil {
+			if fingerprint != "" {
+				if err := fingerprintStore.Save(cacheInput.Key, fingerprint); err != nil {
+					step.logger.Warnf(fmtWarnFingerprintSaveFailed, cacheInput.Key, err.Error())
+				}
+			}
+			return false, nil
 		}
-	}
+		lastErr = err
 
-	if len(errs) == len(lines) {
-		return nil, nil, errors.New(fmtErrNoKeyPathPairs)
+		if attempt == retryCount {
+			break
+		}
+
+		delay := backoffDelay(retryBackoff, attempt)
+		step.logger.Warnf(fmtWarnRetryingSave, cacheInput.Key, attempt+1, retryCount, lastErr.Error())
+		time.Sleep(delay)
 	}
 
-	return pathMap, uniquenessMap, nil
+	return false, &keyError{Key: cacheInput.Key, Attempts: retryCount + 1, Err: lastErr}
 }
 
-type CacheInput struct {
-	Verbose          bool     `env:"verbose,required"`
-	Key              string   `env:"key,required"`
-	Paths            []string `env:"paths,required"`
-	IsKeyUnique      bool     `env:"is_key_unique"`
-	CompressionLevel int      `env:"compression_level,range[1..19]"`
-	CustomTarArgs    string   `env:"custom_tar_args"`
+func backoffDelay(base time.Duration, attempt int) time.Duration {
+	delay := base << attempt
+	if delay > maxRetryBackoff || delay <= 0 {
+		delay = maxRetryBackoff
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay)/2 + 1))
+	delay = delay/2 + jitter
+	if delay > maxRetryBackoff {
+		delay = maxRetryBackoff
+	}
+	return delay
 }
 
-func save(
-	step MultikeySaveCacheStep,
-	cacheInput CacheInput,
-	wg *sync.WaitGroup,
-	errors chan<- error,
-) {
-	defer wg.Done()
-
+// save performs the actual tar+upload for a single key. Skip-checks and
+// fingerprinting are handled once by the caller, outside the retry loop,
+// since neither changes between retry attempts.
+func save(step MultikeySaveCacheStep, cacheInput CacheInput) error {
 	saver := cache.NewSaver(
 		step.envRepo,
 		step.logger,
@@ -214,7 +314,7 @@ func save(
 		nil,
 	)
 
-	err := saver.Save(cache.SaveCacheInput{
+	return saver.Save(cache.SaveCacheInput{
 		StepId:           stepId,
 		Verbose:          cacheInput.Verbose,
 		Key:              cacheInput.Key,
@@ -223,8 +323,25 @@ func save(
 		CompressionLevel: cacheInput.CompressionLevel,
 		CustomTarArgs:    strings.Fields(cacheInput.CustomTarArgs),
 	})
+}
+
+func (step MultikeySaveCacheStep) exportOutput(key, value string) {
+	cmd := step.commandFactory.Create("envman", []string{"add", "--key", key, "--value", value}, nil)
+	if err := cmd.Run(); err != nil {
+		step.logger.Warnf(fmtWarnFailedToExportOutput, key, err.Error())
+	}
+}
+
+func cacheKeyExists(step MultikeySaveCacheStep, key string) (bool, error) {
+	restorer := cache.NewRestorer(step.envRepo, step.logger, step.pathProvider, step.pathChecker, step.commandFactory)
 
+	result, err := restorer.Restore(cache.RestoreCacheInput{
+		StepId: stepId,
+		Keys:   []string{key},
+	})
 	if err != nil {
-		errors <- err
+		return false, err
 	}
+
+	return result.MatchedKey != "", nil
 }
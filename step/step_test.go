@@ -0,0 +1,41 @@
+package step
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay_NeverExceedsMaxAndNeverNonPositive(t *testing.T) {
+	base := 2 * time.Second
+
+	for attempt := 0; attempt < 20; attempt++ {
+		for i := 0; i < 50; i++ {
+			delay := backoffDelay(base, attempt)
+			if delay <= 0 {
+				t.Fatalf("attempt %d: expected a positive delay, got %s", attempt, delay)
+			}
+			if delay > maxRetryBackoff {
+				t.Fatalf("attempt %d: expected delay to be capped at %s, got %s", attempt, maxRetryBackoff, delay)
+			}
+		}
+	}
+}
+
+func TestKeyError_ErrorAndUnwrap(t *testing.T) {
+	cause := errors.New("upload failed")
+	err := &keyError{Key: "my-key", Attempts: 3, Err: cause}
+
+	if !errors.Is(err, cause) {
+		t.Error("expected keyError to unwrap to its underlying cause")
+	}
+
+	message := err.Error()
+	if !strings.Contains(message, "my-key") || !strings.Contains(message, "3") || !strings.Contains(message, cause.Error()) {
+		t.Errorf("expected error message to mention the key, attempt count and cause, got %q", message)
+	}
+	if strings.Contains(message, "%!") {
+		t.Errorf("expected a cleanly formatted error message, got %q", message)
+	}
+}